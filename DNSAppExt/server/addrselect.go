@@ -0,0 +1,249 @@
+package dnsext
+
+import (
+	"net"
+	"sort"
+)
+
+// addrselect orders a resolved A+AAAA set per RFC 6724 so the DoH
+// bootstrap dialer tries the best candidate destination first, in
+// place of the old "prefer IPv6, interleave" heuristic (mixAddrs),
+// which causes dial timeouts on IPv4-only cellular or broken IPv6
+// networks. Loosely based on the unexported net/addrselect.go in the
+// Go standard library. Of the RFC 6724 destination rules, 1, 2, 4, 5,
+// 7 and 8 are applied; rule 3 (avoid deprecated source addresses) and
+// rule 6 (prefer native transport) are not.
+
+type policyTableEntry struct {
+	prefix     *net.IPNet
+	precedence uint8
+	label      uint8
+}
+
+func cidr(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// policyTable is the RFC 6724 section 2.1 default policy table, ordered
+// most to least specific prefix so classify can stop at the first
+// match.
+var policyTable = []policyTableEntry{
+	{cidr("::1/128"), 50, 0},
+	{cidr("::ffff:0:0/96"), 35, 4},
+	{cidr("::/96"), 1, 3},
+	{cidr("2001::/32"), 5, 5},
+	{cidr("2002::/16"), 30, 2},
+	{cidr("fe80::/10"), 1, 1},
+	{cidr("fc00::/7"), 3, 13},
+	{cidr("::/0"), 40, 1},
+}
+
+func classify(ip net.IP) (precedence, label uint8) {
+	for _, p := range policyTable {
+		if p.prefix.Contains(ip) {
+			return p.precedence, p.label
+		}
+	}
+	return 40, 1
+}
+
+const (
+	scopeInterfaceLocal uint8 = 1
+	scopeLinkLocal      uint8 = 2
+	scopeSiteLocal      uint8 = 5
+	scopeGlobal         uint8 = 14
+)
+
+func addrScope(ip net.IP) uint8 {
+	if ip.IsMulticast() {
+		return ip[1] & 0xf
+	}
+	if ip.IsInterfaceLocalMulticast() {
+		return scopeInterfaceLocal
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return scopeLinkLocal
+	}
+	return scopeGlobal
+}
+
+// commonPrefixLen returns the number of leading bits a and b (both
+// 16-byte form) have in common, used as the rule 8 tie-break.
+func commonPrefixLen(a, b net.IP) int {
+	l := 0
+	for i := 0; i < net.IPv6len && i < len(a) && i < len(b); i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			l += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			l++
+			x <<= 1
+		}
+		break
+	}
+	return l
+}
+
+// pickSourceAddr returns the candidate source address addrselect would
+// use to reach dst, preferring matching scope then smallest scope. It
+// only considers srcs of the same family as dst: a source of the wrong
+// family can't actually be used to dial dst, so returning one here would
+// make an unreachable destination (e.g. an IPv6 address on an
+// IPv4-only device) look like it has a usable source. Returns nil if
+// srcs has no member of dst's family, which rfc6724Less treats as an
+// unusable destination per rule 1.
+func pickSourceAddr(dst net.IP, srcs []net.IP) net.IP {
+	dstIsV4 := dst.To4() != nil
+	dstScope := addrScope(dst)
+
+	var best net.IP
+	bestScope := uint8(255)
+	for _, src := range srcs {
+		if (src.To4() != nil) != dstIsV4 {
+			continue
+		}
+		sc := addrScope(src.To16())
+		if sc == dstScope {
+			return src
+		}
+		if sc < bestScope {
+			bestScope = sc
+			best = src
+		}
+	}
+	return best
+}
+
+// rankedAddr carries the destination and (if any) matching source
+// address properties needed to apply the RFC 6724 ordering rules.
+type rankedAddr struct {
+	ip    net.IP
+	scope uint8
+	prec  uint8
+	label uint8
+
+	srcSet          bool
+	srcScope        uint8
+	srcLabel        uint8
+	commonPrefixLen int
+}
+
+func rfc6724Less(a, b rankedAddr) bool {
+	// Rule 1: avoid unusable destinations. A destination of a family the
+	// device has no local address for (e.g. an IPv6 destination on an
+	// IPv4-only device) can't be dialed from any source we have, so it
+	// ranks behind anything we do have a usable source for, regardless
+	// of precedence.
+	if a.srcSet != b.srcSet {
+		return a.srcSet
+	}
+
+	// Rule 2: prefer matching scope.
+	if a.srcSet && b.srcSet {
+		aMatch := a.scope == a.srcScope
+		bMatch := b.scope == b.srcScope
+		if aMatch != bMatch {
+			return aMatch
+		}
+	}
+
+	// Rule 4: prefer matching label.
+	if a.srcSet && b.srcSet {
+		aMatch := a.label == a.srcLabel
+		bMatch := b.label == b.srcLabel
+		if aMatch != bMatch {
+			return aMatch
+		}
+	}
+
+	// Rule 5: prefer higher precedence.
+	if a.prec != b.prec {
+		return a.prec > b.prec
+	}
+
+	// Rule 7: prefer smaller scope.
+	if a.scope != b.scope {
+		return a.scope < b.scope
+	}
+
+	// Rule 8: longest matching prefix with the chosen source wins.
+	if a.srcSet && b.srcSet && a.commonPrefixLen != b.commonPrefixLen {
+		return a.commonPrefixLen > b.commonPrefixLen
+	}
+
+	return false
+}
+
+// sortAddrs orders dst per RFC 6724 using srcs (typically from
+// net.InterfaceAddrs) as the candidate source addresses. Unspecified
+// destinations are dropped outright; destinations of a family srcs has
+// no member of (e.g. IPv6 on an IPv4-only device) are kept but sorted
+// last by rule 1 in rfc6724Less. The sort is stable so addresses the
+// rules can't distinguish keep their relative resolver-returned order.
+func sortAddrs(dst []net.IP, srcs []net.IP) []net.IP {
+	usable := dst[:0:0]
+	for _, ip := range dst {
+		if !ip.IsUnspecified() {
+			usable = append(usable, ip)
+		}
+	}
+	if len(usable) < 2 {
+		return usable
+	}
+
+	ranked := make([]rankedAddr, len(usable))
+	for i, ip := range usable {
+		ip16 := ip.To16()
+		prec, label := classify(ip16)
+		ranked[i] = rankedAddr{
+			ip:    ip,
+			scope: addrScope(ip16),
+			prec:  prec,
+			label: label,
+		}
+
+		if src := pickSourceAddr(ip16, srcs); src != nil {
+			src16 := src.To16()
+			_, srcLabel := classify(src16)
+			ranked[i].srcSet = true
+			ranked[i].srcScope = addrScope(src16)
+			ranked[i].srcLabel = srcLabel
+			ranked[i].commonPrefixLen = commonPrefixLen(ip16, src16)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return rfc6724Less(ranked[i], ranked[j])
+	})
+
+	out := make([]net.IP, len(ranked))
+	for i, r := range ranked {
+		out[i] = r.ip
+	}
+	return out
+}
+
+// localAddrs returns the device's configured unicast addresses, the
+// candidate source address set for sortAddrs.
+func localAddrs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	return ips
+}
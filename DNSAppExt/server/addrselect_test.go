@@ -0,0 +1,47 @@
+package dnsext
+
+import (
+	"net"
+	"testing"
+)
+
+func ip(s string) net.IP {
+	return net.ParseIP(s)
+}
+
+func TestSortAddrsPrefersReachableFamilyOnIPv4OnlyDevice(t *testing.T) {
+	srcs := []net.IP{ip("192.168.1.5")}
+	dst := []net.IP{ip("2606:4700:4700::1111"), ip("1.1.1.1")}
+
+	got := sortAddrs(dst, srcs)
+	if len(got) != 2 || !got[0].Equal(ip("1.1.1.1")) {
+		t.Fatalf("expected IPv4 destination first on an IPv4-only device, got %v", got)
+	}
+}
+
+func TestSortAddrsPrefersReachableFamilyOnIPv6OnlyDevice(t *testing.T) {
+	srcs := []net.IP{ip("2001:db8::1")}
+	dst := []net.IP{ip("1.1.1.1"), ip("2606:4700:4700::1111")}
+
+	got := sortAddrs(dst, srcs)
+	if len(got) != 2 || !got[0].Equal(ip("2606:4700:4700::1111")) {
+		t.Fatalf("expected IPv6 destination first on an IPv6-only device, got %v", got)
+	}
+}
+
+func TestSortAddrsDropsUnspecifiedDestinations(t *testing.T) {
+	srcs := []net.IP{ip("192.168.1.5")}
+	dst := []net.IP{ip("0.0.0.0"), ip("1.1.1.1")}
+
+	got := sortAddrs(dst, srcs)
+	if len(got) != 1 || !got[0].Equal(ip("1.1.1.1")) {
+		t.Fatalf("expected the unspecified destination dropped, got %v", got)
+	}
+}
+
+func TestPickSourceAddrIgnoresWrongFamily(t *testing.T) {
+	srcs := []net.IP{ip("192.168.1.5")}
+	if src := pickSourceAddr(ip("2606:4700:4700::1111"), srcs); src != nil {
+		t.Fatalf("expected no source for an IPv6 destination with only IPv4 srcs, got %v", src)
+	}
+}
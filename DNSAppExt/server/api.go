@@ -3,6 +3,7 @@ package dnsext
 import (
 	"log"
 	"runtime/debug"
+	"strings"
 	"time"
 	_ "golang.org/x/mobile/bind"
 )
@@ -10,9 +11,33 @@ import (
 var server *Server
 
 
-func InitServer(listenIP4, listenIP6, doh string) int {
+// InitServer creates the resolver server listening on listenIP4/listenIP6.
+// upstreams is a comma-separated list of DoH URLs (https://...) and/or
+// DoT hosts (tls://...), tried according to strategy ("sequential",
+// "parallel" or "loadbalance"; anything else falls back to "sequential").
+// prefetchMinHits enables background refresh of hot cache entries once
+// they've been queried that many times and have prefetchThreshold
+// (0-1) or less of their TTL remaining; pass 0 to disable it.
+// bootstrap is a comma-separated list of "proto://addr" entries used to
+// resolve the upstreams' own hostnames (proto one of udp, tls, https);
+// pass "" to keep the built-in default servers. useOSResolver
+// allows falling back to the OS resolver when every bootstrap server
+// fails or none are configured.
+func InitServer(listenIP4, listenIP6, upstreams, strategy string, prefetchMinHits int, prefetchThreshold float64, bootstrap string, useOSResolver bool) int {
+	if err := SetBootstrap(bootstrap, useOSResolver); err != nil {
+		log.Printf("failed parsing bootstrap servers: %v", err)
+		return -1
+	}
+
 	var err error
-	if server, err = NewServer(listenIP4, listenIP6, doh) ; err != nil {
+	list := strings.Split(upstreams, ",")
+
+	var opts []ServerOption
+	if prefetchMinHits > 0 {
+		opts = append(opts, WithPrefetch(prefetchMinHits, prefetchThreshold))
+	}
+
+	if server, err = NewServer(listenIP4, listenIP6, list, ParseStrategy(strategy), opts...); err != nil {
 		log.Printf("failed creating server: %v", err)
 		return -1
 	}
@@ -20,6 +45,15 @@ func InitServer(listenIP4, listenIP6, doh string) int {
 	return 0
 }
 
+// UpstreamStats returns a "endpoint failures" summary, one upstream per
+// line, for UI display.
+func UpstreamStats() string {
+	if server == nil {
+		return ""
+	}
+	return server.upstreamStatsReport()
+}
+
 func CloseIdleConnections() {
 	if server == nil {
 		return
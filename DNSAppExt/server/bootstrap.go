@@ -0,0 +1,287 @@
+package dnsext
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BootstrapProto is the transport a Bootstrap server is queried over
+// to resolve a DoH upstream's own hostname.
+type BootstrapProto int
+
+const (
+	BootstrapUDP BootstrapProto = iota
+	BootstrapDoT
+	BootstrapDoH
+	// BootstrapDoQ is reserved for DoQ (DNS-over-QUIC) bootstrap
+	// servers. There's no QUIC transport wired up yet, so
+	// ParseBootstrapProto doesn't accept it and queryServer has no case
+	// for it; setting Proto to this value directly fails at query time.
+	BootstrapDoQ
+)
+
+// BootstrapServer is one configured {addr, proto} bootstrap resolver.
+// Addr is a bare host for BootstrapUDP/BootstrapDoT (the port is
+// added per-proto by addrList) or a full DoH URL for BootstrapDoH.
+type BootstrapServer struct {
+	Addr  string
+	Proto BootstrapProto
+}
+
+// ParseBootstrapProto maps a scheme name to a BootstrapProto. "quic"/
+// "doq" are rejected, not just unimplemented: queryServer has no DoQ
+// transport to run them over yet, so accepting them here would let a
+// bootstrap server silently never work.
+func ParseBootstrapProto(s string) (BootstrapProto, error) {
+	switch strings.ToLower(s) {
+	case "udp":
+		return BootstrapUDP, nil
+	case "tls", "dot":
+		return BootstrapDoT, nil
+	case "https", "doh":
+		return BootstrapDoH, nil
+	case "quic", "doq":
+		return 0, fmt.Errorf("bootstrap proto %q isn't supported yet", s)
+	default:
+		return 0, fmt.Errorf("unknown bootstrap proto %q", s)
+	}
+}
+
+// ParseBootstrapServers parses "proto://addr" entries, e.g.
+// "udp://1.1.1.1", "tls://9.9.9.9", "https://1.1.1.1/dns-query".
+func ParseBootstrapServers(raw []string) ([]BootstrapServer, error) {
+	var servers []BootstrapServer
+	for _, entry := range raw {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		idx := strings.Index(entry, "://")
+		if idx < 0 {
+			return nil, fmt.Errorf("bad bootstrap server %q: missing proto://", entry)
+		}
+
+		proto, err := ParseBootstrapProto(entry[:idx])
+		if err != nil {
+			return nil, err
+		}
+
+		addr := entry[idx+len("://"):]
+		if proto == BootstrapDoH {
+			addr = entry // DoH needs the full URL, scheme included
+		}
+		servers = append(servers, BootstrapServer{Addr: addr, Proto: proto})
+	}
+	return servers, nil
+}
+
+// bootstrapHedgeDelay is how long Bootstrap waits for the best-scored
+// server before also racing the second-best.
+const bootstrapHedgeDelay = 150 * time.Millisecond
+
+// Bootstrap is the set of resolvers used to find a DoH upstream's own
+// address. It selects among its configured servers by a rolling
+// success/latency score rather than static order, hedging the top two
+// scored servers to cut tail latency. The scoreboard lives on
+// Bootstrap itself, independent of the transport's connection pool, so
+// it persists across MobileTransport.CloseAllConnections calls.
+type Bootstrap struct {
+	useOS bool
+
+	mu      sync.RWMutex
+	servers []BootstrapServer
+	scores  map[BootstrapServer]*upstreamStats
+}
+
+// NewBootstrap builds a Bootstrap over servers. useOS controls whether
+// the OS resolver (net.LookupIP) may be used as a final fallback when
+// every configured server fails or none are configured; privacy-
+// focused configurations pass false, verified-boot ones that require
+// DoT/DoH only also pass false.
+func NewBootstrap(servers []BootstrapServer, useOS bool) *Bootstrap {
+	scores := make(map[BootstrapServer]*upstreamStats, len(servers))
+	for _, s := range servers {
+		scores[s] = &upstreamStats{}
+	}
+	return &Bootstrap{
+		useOS:   useOS,
+		servers: servers,
+		scores:  scores,
+	}
+}
+
+func (b *Bootstrap) ranked() []BootstrapServer {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	ranked := make([]BootstrapServer, len(b.servers))
+	copy(ranked, b.servers)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return b.scores[ranked[i]].score() < b.scores[ranked[j]].score()
+	})
+	return ranked
+}
+
+func (b *Bootstrap) record(srv BootstrapServer, rtt time.Duration, err error) {
+	b.mu.RLock()
+	stats := b.scores[srv]
+	b.mu.RUnlock()
+	if stats != nil {
+		stats.record(rtt, err)
+	}
+}
+
+type bootstrapResult struct {
+	ip4, ip6 []net.IP
+	exp      time.Time
+	err      error
+	srv      BootstrapServer
+}
+
+// lookup resolves host using the configured bootstrap servers: it
+// races the top two scored servers (issuing the second after
+// bootstrapHedgeDelay if the first hasn't returned yet, or at once if
+// the first has already failed), fails over
+// through any remaining servers in score order, and finally falls
+// back to the OS resolver if useOS allows it.
+func (b *Bootstrap) lookup(ctx context.Context, a *addrList, host string) ([]net.IP, time.Time, error) {
+	ranked := b.ranked()
+	if len(ranked) == 0 {
+		return b.lookupOS(host)
+	}
+
+	results := make(chan bootstrapResult, 2)
+	try := func(srv BootstrapServer) {
+		start := time.Now()
+		ip4, ip6, exp, err := a.queryServer(ctx, host, srv)
+		b.record(srv, time.Since(start), err)
+		results <- bootstrapResult{ip4, ip6, exp, err, srv}
+	}
+
+	go try(ranked[0])
+	pending := 1
+
+	if len(ranked) > 1 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				logBootstrapHit(res.srv)
+				return append(res.ip4, res.ip6...), res.exp, nil
+			}
+			// the only in-flight server already failed, hedge now
+			go try(ranked[1])
+			pending++
+		case <-time.After(bootstrapHedgeDelay):
+			go try(ranked[1])
+			pending++
+		case <-ctx.Done():
+			return nil, time.Time{}, ctx.Err()
+		}
+	}
+
+	var lastErr error
+	for ; pending > 0; pending-- {
+		select {
+		case res := <-results:
+			if res.err == nil {
+				logBootstrapHit(res.srv)
+				return append(res.ip4, res.ip6...), res.exp, nil
+			}
+			lastErr = res.err
+		case <-ctx.Done():
+			return nil, time.Time{}, ctx.Err()
+		}
+	}
+
+	rest := ranked
+	if len(rest) > 2 {
+		rest = rest[2:]
+	} else {
+		rest = nil
+	}
+
+	for _, srv := range rest {
+		select {
+		case <-ctx.Done():
+			return nil, time.Time{}, fmt.Errorf("lookup failed context deadline exceeded")
+		default:
+		}
+
+		start := time.Now()
+		ip4, ip6, exp, err := a.queryServer(ctx, host, srv)
+		b.record(srv, time.Since(start), err)
+		if err == nil {
+			logBootstrapHit(srv)
+			return append(ip4, ip6...), exp, nil
+		}
+		lastErr = err
+	}
+
+	if b.useOS {
+		return b.lookupOS(host)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no bootstrap servers configured")
+	}
+	return nil, time.Time{}, lastErr
+}
+
+func (b *Bootstrap) lookupOS(host string) ([]net.IP, time.Time, error) {
+	if !b.useOS {
+		return nil, time.Time{}, fmt.Errorf("no bootstrap servers configured and the OS resolver is disabled")
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for _, ip := range ips {
+		// only accept if addr isn't 0.0.0.0
+		if !ip.IsUnspecified() {
+			return ips, time.Now().Add(time.Minute), nil
+		}
+	}
+	return nil, time.Time{}, fmt.Errorf("no usable addresses found")
+}
+
+func logBootstrapHit(srv BootstrapServer) {
+	log.Printf("found address using bootstrap server: %s", srv.Addr)
+}
+
+// SetBootstrap configures the bootstrap resolvers used to find DoH
+// upstream addresses. raw is a comma-separated list of "proto://addr"
+// entries (proto one of udp, tls/dot, https/doh); an empty raw keeps
+// the built-in default server list. useOS controls whether the OS
+// resolver may be used as a final fallback.
+func SetBootstrap(raw string, useOS bool) error {
+	servers := defaultBootstrapServers()
+	if strings.TrimSpace(raw) != "" {
+		parsed, err := ParseBootstrapServers(strings.Split(raw, ","))
+		if err != nil {
+			return err
+		}
+		servers = parsed
+	}
+
+	addrRes.setBootstrap(NewBootstrap(servers, useOS))
+	return nil
+}
+
+// defaultBootstrapServers preserves the original hard-coded fallback
+// list, queried over DoT, for when InitServer isn't given an explicit
+// bootstrap configuration.
+func defaultBootstrapServers() []BootstrapServer {
+	servers := make([]BootstrapServer, len(bootstrapAddresses))
+	for i, addr := range bootstrapAddresses {
+		servers[i] = BootstrapServer{Addr: addr, Proto: BootstrapDoT}
+	}
+	return servers
+}
@@ -0,0 +1,65 @@
+package dnsext
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseBootstrapServers(t *testing.T) {
+	servers, err := ParseBootstrapServers([]string{
+		"udp://1.1.1.1",
+		" tls://9.9.9.9 ",
+		"https://1.1.1.1/dns-query",
+		"",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(servers) != 3 {
+		t.Fatalf("expected 3 servers, got %d", len(servers))
+	}
+
+	if servers[0].Proto != BootstrapUDP || servers[0].Addr != "1.1.1.1" {
+		t.Fatalf("unexpected udp entry: %+v", servers[0])
+	}
+	if servers[1].Proto != BootstrapDoT || servers[1].Addr != "9.9.9.9" {
+		t.Fatalf("unexpected tls entry: %+v", servers[1])
+	}
+	if servers[2].Proto != BootstrapDoH || servers[2].Addr != "https://1.1.1.1/dns-query" {
+		t.Fatalf("unexpected https entry: %+v", servers[2])
+	}
+}
+
+func TestParseBootstrapServersRejectsBadEntry(t *testing.T) {
+	if _, err := ParseBootstrapServers([]string{"1.1.1.1"}); err == nil {
+		t.Fatal("expected error for entry missing proto://")
+	}
+	if _, err := ParseBootstrapServers([]string{"quic2://1.1.1.1"}); err == nil {
+		t.Fatal("expected error for unknown proto")
+	}
+}
+
+func TestParseBootstrapProtoRejectsDoQ(t *testing.T) {
+	// DoQ isn't wired up to any transport yet; it must be rejected at
+	// parse time rather than accepted and silently fail every query.
+	if _, err := ParseBootstrapProto("quic"); err == nil {
+		t.Fatal("expected error for unsupported quic proto")
+	}
+	if _, err := ParseBootstrapProto("doq"); err == nil {
+		t.Fatal("expected error for unsupported doq proto")
+	}
+}
+
+func TestBootstrapRankedOrdersByScore(t *testing.T) {
+	good := BootstrapServer{Addr: "1.1.1.1", Proto: BootstrapDoT}
+	bad := BootstrapServer{Addr: "9.9.9.9", Proto: BootstrapDoT}
+
+	b := NewBootstrap([]BootstrapServer{bad, good}, false)
+	b.scores[bad].record(0, errors.New("fake bootstrap failure"))
+	b.scores[good].record(0, nil)
+
+	ranked := b.ranked()
+	if ranked[0] != good {
+		t.Fatalf("expected %+v ranked first, got %+v", good, ranked[0])
+	}
+}
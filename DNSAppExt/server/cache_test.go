@@ -0,0 +1,92 @@
+package dnsext
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// nxdomainWithSOA builds a crafted NXDOMAIN reply carrying an SOA
+// record in the authority section, as a resolver would for negative
+// caching per RFC 2308.
+func nxdomainWithSOA(minimum, soaTtl uint32) *dns.Msg {
+	m := &dns.Msg{}
+	m.SetQuestion("nope.example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = []dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "example.com.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    soaTtl,
+		},
+		Ns:      "ns1.example.com.",
+		Mbox:    "hostmaster.example.com.",
+		Minttl:  minimum,
+	}}
+	return m
+}
+
+func TestNegativeTTLUsesSOAMinimum(t *testing.T) {
+	m := nxdomainWithSOA(120, 3600)
+	if ttl := negativeTTL(m); ttl != 120*time.Second {
+		t.Fatalf("expected 120s, got %v", ttl)
+	}
+}
+
+func TestNegativeTTLUsesSmallerOfSOAHeaderAndMinimum(t *testing.T) {
+	m := nxdomainWithSOA(3600, 120)
+	if ttl := negativeTTL(m); ttl != 120*time.Second {
+		t.Fatalf("expected 120s, got %v", ttl)
+	}
+}
+
+func TestNegativeTTLClampedToMinTTL(t *testing.T) {
+	m := nxdomainWithSOA(1, 1)
+	if ttl := negativeTTL(m); ttl != minTTL {
+		t.Fatalf("expected ttl clamped to minTTL (%v), got %v", minTTL, ttl)
+	}
+}
+
+func TestNegativeTTLClampedToMaxTTL(t *testing.T) {
+	m := nxdomainWithSOA(1<<31, 1<<31)
+	if ttl := negativeTTL(m); ttl != maxTTL {
+		t.Fatalf("expected ttl clamped to maxTTL (%v), got %v", maxTTL, ttl)
+	}
+}
+
+func TestNegativeTTLFallsBackToMinTTLWithoutSOA(t *testing.T) {
+	m := &dns.Msg{}
+	m.SetQuestion("nope.example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+
+	if ttl := negativeTTL(m); ttl != minTTL {
+		t.Fatalf("expected minTTL (%v), got %v", minTTL, ttl)
+	}
+}
+
+func TestGetCacheTTLPrefersNegativeTTLWhenNoAnswers(t *testing.T) {
+	m := nxdomainWithSOA(300, 300)
+	if ttl := getCacheTTL(m); ttl != 300*time.Second {
+		t.Fatalf("expected 300s, got %v", ttl)
+	}
+}
+
+func TestIsACMEChallenge(t *testing.T) {
+	cases := []struct {
+		name  string
+		qtype uint16
+		want  bool
+	}{
+		{"_acme-challenge.example.com.", dns.TypeTXT, true},
+		{"_ACME-CHALLENGE.example.com.", dns.TypeTXT, true},
+		{"_acme-challenge.example.com.", dns.TypeA, false},
+		{"example.com.", dns.TypeTXT, false},
+	}
+
+	for _, c := range cases {
+		if got := isACMEChallenge(c.name, c.qtype); got != c.want {
+			t.Errorf("isACMEChallenge(%q, %d) = %v, want %v", c.name, c.qtype, got, c.want)
+		}
+	}
+}
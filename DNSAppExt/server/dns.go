@@ -6,26 +6,40 @@ import (
 	"fmt"
 	"github.com/hashicorp/golang-lru"
 	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 	"hash/fnv"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	minTTL = 1 * time.Minute
 	maxTTL = 6 * time.Hour
+
+	// servfailTTL is how long a SERVFAIL response is cached for, so a
+	// bursty app doesn't hammer the upstream during an outage. It is
+	// intentionally short: a SERVFAIL is never served past this window.
+	servfailTTL = 5 * time.Second
 )
 
 type Server struct {
 	http  http.Client
-	url   *url.URL
 	dns   dns.Client
 	cache *lru.Cache
-	addr  string
+	// sf deduplicates concurrent identical (qname, qtype) queries so
+	// only one outbound exchange is in flight at a time.
+	sf singleflight.Group
+
+	upstreams []Upstream
+	strategy  Strategy
+
+	// prefetch is nil unless WithPrefetch was passed to NewServer.
+	prefetch *prefetcher
 
 	ipv4Loopback *dns.Server
 	ipv6Loopback *dns.Server
@@ -34,21 +48,26 @@ type Server struct {
 type cacheEntry struct {
 	msg    *dns.Msg
 	expire time.Time
+	ttl    time.Duration
+	hits   uint64 // atomic, queries served from this entry
 }
 
-func NewServer(listenAddr string, dohServer string) (s *Server, err error) {
+// NewServer creates a resolver listening on listenIP4/listenIP6 that
+// forwards queries to upstreams (DoH URLs or "tls://" DoT hosts)
+// according to strategy.
+func NewServer(listenIP4, listenIP6 string, upstreams []string, strategy Strategy, opts ...ServerOption) (s *Server, err error) {
 	s = &Server{
-		http: http.Client{},
-		dns:  dns.Client{},
-		addr: listenAddr,
+		http:     http.Client{},
+		dns:      dns.Client{},
+		strategy: strategy,
 		ipv4Loopback: &dns.Server{
-			Addr:         "127.0.0.1:53",
+			Addr:         listenIP4,
 			Net:          "udp",
 			ReadTimeout:  10 * time.Second,
 			WriteTimeout: 10 * time.Second,
 		},
 		ipv6Loopback: &dns.Server{
-			Addr:         "[::1]:53",
+			Addr:         listenIP6,
 			Net:          "udp",
 			ReadTimeout:  10 * time.Second,
 			WriteTimeout: 10 * time.Second,
@@ -60,7 +79,7 @@ func NewServer(listenAddr string, dohServer string) (s *Server, err error) {
 	s.ipv6Loopback.Handler = s.handleDnsRequest()
 	s.http.Timeout = time.Second * 6
 
-	if s.url, err = url.Parse(dohServer); err != nil {
+	if s.upstreams, err = parseUpstreams(upstreams, &s.http); err != nil {
 		return nil, err
 	}
 
@@ -68,6 +87,10 @@ func NewServer(listenAddr string, dohServer string) (s *Server, err error) {
 		return nil, fmt.Errorf("failed cache init: %v", err)
 	}
 
+	for _, opt := range opts {
+		opt(s)
+	}
+
 	return s, nil
 }
 
@@ -84,50 +107,120 @@ func (s *Server) exchangeWithCache(ctx context.Context, req *dns.Msg) (*dns.Msg,
 		return nil, fmt.Errorf("bad question")
 	}
 	req.Question[0].Name = dns.CanonicalName(req.Question[0].Name)
+	q := req.Question[0]
+
+	// certificate renewal must never see a stale negative
+	skipCache := isACMEChallenge(q.Name, q.Qtype)
+
+	key := hash(q.Name, q.Qtype)
+	if !skipCache {
+		if val, ok := s.cache.Get(key); ok {
+			r := val.(*cacheEntry)
+			if time.Now().Before(r.expire) {
+				ttl := uint32(r.expire.Sub(time.Now()).Seconds())
+				for _, rr := range r.msg.Answer {
+					rr.Header().Ttl = ttl
+				}
+				for _, rr := range r.msg.Ns {
+					rr.Header().Ttl = ttl
+				}
 
-	key := hash(req.Question[0].Name, req.Question[0].Qtype)
-	if val, ok := s.cache.Get(key); ok {
-		r := val.(*cacheEntry)
-		if time.Now().Before(r.expire) {
-			ttl := uint32(r.expire.Sub(time.Now()).Seconds())
-			for _, rr := range r.msg.Answer {
-				rr.Header().Ttl = ttl
-			}
-
-			// check for collisions
-			if strings.EqualFold(req.Question[0].Name, r.msg.Question[0].Name) {
-				return r.msg, nil
+				// check for collisions
+				if strings.EqualFold(q.Name, r.msg.Question[0].Name) {
+					hits := atomic.AddUint64(&r.hits, 1)
+					s.maybePrefetch(key, req, r, hits)
+					return r.msg, nil
+				}
 			}
+			s.cache.Remove(key)
 		}
-		s.cache.Remove(key)
 	}
 
-	r, _, err := s.exchange(ctx, req)
+	return s.refresh(ctx, req, key, skipCache)
+}
+
+// refresh runs req past the cache straight to the singleflight-backed
+// upstream exchange, writing the result back into the cache (unless
+// skipCache). exchangeWithCache calls this on a cache miss; maybePrefetch
+// also calls it directly so a background refresh of a still-valid entry
+// actually reaches the upstream instead of being short-circuited by the
+// cache-hit check in exchangeWithCache.
+func (s *Server) refresh(ctx context.Context, req *dns.Msg, key uint64, skipCache bool) (*dns.Msg, error) {
+	q := req.Question[0]
+
+	// dedupe concurrent identical queries so only one outbound exchange
+	// is in flight; the cache is populated once, inside, by whichever
+	// caller's request actually ran. Its context's deadline is the one
+	// that governs the shared exchange.
+	v, err, _ := s.sf.Do(strconv.FormatUint(key, 36), func() (interface{}, error) {
+		r, _, err := s.exchange(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		s.storeCacheEntry(key, r, skipCache)
+		return r, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	// every waiter gets its own copy, rewritten with its own request ID
+	r := v.(*dns.Msg).Copy()
+
+	// the singleflight group is keyed by the same bare hash as the
+	// cache; on a collision with a concurrent, different-qname query
+	// sharing this key, the group hands every waiter the first caller's
+	// answer. Detect that the same way the cache-read path does and
+	// exchange for real rather than handing back someone else's answer.
+	if len(r.Question) == 0 || !strings.EqualFold(r.Question[0].Name, q.Name) || r.Question[0].Qtype != q.Qtype {
+		if r, _, err = s.exchange(ctx, req); err != nil {
+			return nil, err
+		}
+		s.storeCacheEntry(key, r, skipCache)
+	}
+
+	r.Id = req.Id
+	return r, nil
+}
+
+// storeCacheEntry caches r under key unless skipCache, using the short
+// servfailTTL for a SERVFAIL response and the RFC 2308/record TTL for
+// everything else.
+func (s *Server) storeCacheEntry(key uint64, r *dns.Msg, skipCache bool) {
+	if skipCache {
+		return
+	}
+
 	if r.Rcode == dns.RcodeServerFailure {
-		return r, nil
+		// cache briefly so a bursty app doesn't hammer the upstream
+		// during an outage, but never serve it past servfailTTL
+		s.cache.Add(key, &cacheEntry{
+			msg:    r,
+			expire: time.Now().Add(servfailTTL),
+			ttl:    servfailTTL,
+		})
+		return
 	}
 
 	// clear extra section
 	r.Extra = nil
-	ttl := getMinTTL(r)
+	ttl := getCacheTTL(r)
 	s.cache.Add(key, &cacheEntry{
 		msg:    r,
 		expire: time.Now().Add(ttl),
+		ttl:    ttl,
 	})
+}
 
-	return r, nil
+// isACMEChallenge reports whether q is an _acme-challenge TXT lookup,
+// which must never be answered from cache so on-device certificate
+// renewal isn't broken by a stale negative.
+func isACMEChallenge(qname string, qtype uint16) bool {
+	return qtype == dns.TypeTXT && strings.HasPrefix(strings.ToLower(qname), "_acme-challenge.")
 }
 
 func (s *Server) exchange(ctx context.Context, msg *dns.Msg) (re *dns.Msg, rtt time.Duration, err error) {
-	re, rtt, err = s.dns.ExchangeWithConn(msg, &dns.Conn{Conn: &dohConn{
-		endpoint: s.url,
-		http:     &s.http,
-		ctx:      ctx,
-	}})
+	re, rtt, err = exchangeUpstreams(ctx, s.upstreams, s.strategy, msg)
 
 	if err == nil {
 		if re.Truncated {
@@ -138,6 +231,55 @@ func (s *Server) exchange(ctx context.Context, msg *dns.Msg) (re *dns.Msg, rtt t
 	return
 }
 
+// upstreamStatsReport returns a "endpoint failures" summary, one
+// upstream per line, for UI display.
+func (s *Server) upstreamStatsReport() string {
+	var b strings.Builder
+	for _, u := range s.upstreams {
+		fmt.Fprintf(&b, "%s %d\n", u.String(), u.Stats().Failures())
+	}
+	return b.String()
+}
+
+// getCacheTTL returns how long to cache m for. Per RFC 2308, a
+// negative response (NXDOMAIN or NODATA, i.e. no answer records) is
+// cached using the SOA-derived negative TTL rather than getMinTTL's
+// hard-coded fail-safe.
+func getCacheTTL(m *dns.Msg) time.Duration {
+	if len(m.Answer) == 0 {
+		return negativeTTL(m)
+	}
+	return getMinTTL(m)
+}
+
+// negativeTTL derives the RFC 2308 negative-caching TTL for an
+// NXDOMAIN/NODATA response from min(SOA.Minttl, SOA record TTL) in
+// the authority section, clamped to [minTTL, maxTTL]. Falls back to
+// minTTL if no SOA is present.
+func negativeTTL(m *dns.Msg) time.Duration {
+	for _, rr := range m.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := soa.Minttl
+		if rrTTL := soa.Hdr.Ttl; rrTTL < ttl {
+			ttl = rrTTL
+		}
+
+		switch d := time.Duration(ttl) * time.Second; {
+		case d < minTTL:
+			return minTTL
+		case d > maxTTL:
+			return maxTTL
+		default:
+			return d
+		}
+	}
+	return minTTL
+}
+
 // getMinTTL get the ttl for dns msg
 // borrowed from coredns: https://github.com/coredns/coredns/blob/master/plugin/pkg/dnsutil/ttl.go
 func getMinTTL(m *dns.Msg) time.Duration {
@@ -254,13 +396,18 @@ func (s *Server) handleDnsRequest() dns.HandlerFunc {
 
 func (s *Server) ListenAndServe() {
 	log.Printf("starting listening")
-	// attempt to find & cache DoH address
-	host, _, err := net.SplitHostPort(s.url.Host)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err == nil {
-		go addrRes.lookupDialAddrList(ctx, host)
+	// attempt to find & cache each DoH upstream's address up front
+	for _, u := range s.upstreams {
+		doh, ok := u.(*dohUpstream)
+		if !ok {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(doh.endpoint.Host); err == nil {
+			go addrRes.lookupDialAddrList(ctx, host)
+		}
 	}
 
 	go func() {
@@ -268,7 +415,7 @@ func (s *Server) ListenAndServe() {
 		s.Shutdown()
 	}()
 
-	err = s.ipv4Loopback.ListenAndServe()
+	err := s.ipv4Loopback.ListenAndServe()
 	if err != nil {
 		log.Printf("udp server listen and serve error: %v", err)
 	}
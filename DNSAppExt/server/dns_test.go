@@ -11,12 +11,12 @@ import (
 )
 
 func TestServer_ListenAndServe(t *testing.T) {
-	InitServer("127.0.0.1:5451", "https://hns.dnssec.dev/dns-query")
+	InitServer("127.0.0.1:5451", "[::1]:5451", "https://hns.dnssec.dev/dns-query", "sequential", 0, 0, "", true)
 	ListenAndServe()
 }
 
 func TestNewServer(t *testing.T) {
-	InitServer("127.0.0.1:5450", "https://hns.dnssec.dev/dns-query")
+	InitServer("127.0.0.1:5450", "[::1]:5450", "https://hns.dnssec.dev/dns-query", "sequential", 0, 0, "", true)
 	go ListenAndServe()
 
 	time.Sleep(1 * time.Second)
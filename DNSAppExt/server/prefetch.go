@@ -0,0 +1,95 @@
+package dnsext
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// prefetchWorkers bounds how many background refreshes can run at
+// once, so a burst of expiring hot entries can't spawn unbounded
+// goroutines.
+const prefetchWorkers = 8
+
+// prefetcher holds the optional background-refresh configuration set
+// by WithPrefetch. A nil *prefetcher (the default) disables prefetch.
+type prefetcher struct {
+	minHits   int
+	threshold float64
+
+	sem      chan struct{}
+	inflight sync.Map // key uint64 -> struct{}
+}
+
+// ServerOption configures optional Server behavior at construction
+// time.
+type ServerOption func(*Server)
+
+// WithPrefetch enables background refresh of cache entries that have
+// been queried at least minHits times and have threshold (0-1) or less
+// of their TTL remaining, so the next real query still gets a cache
+// hit instead of a cold miss.
+func WithPrefetch(minHits int, threshold float64) ServerOption {
+	return func(s *Server) {
+		s.prefetch = &prefetcher{
+			minHits:   minHits,
+			threshold: threshold,
+			sem:       make(chan struct{}, prefetchWorkers),
+		}
+	}
+}
+
+// due reports whether entry has been queried often enough and is
+// close enough to expiry to warrant a background refresh.
+func (p *prefetcher) due(entry *cacheEntry, hits uint64) bool {
+	if hits < uint64(p.minHits) || entry.ttl <= 0 {
+		return false
+	}
+	remaining := time.Until(entry.expire)
+	return float64(remaining)/float64(entry.ttl) <= p.threshold
+}
+
+// maybePrefetch kicks off an async refresh of entry if it qualifies:
+// queried often enough and close enough to expiry. It's a no-op when
+// prefetch is disabled, the entry doesn't qualify yet, a refresh for
+// key is already in flight, or the worker pool is saturated.
+func (s *Server) maybePrefetch(key uint64, req *dns.Msg, entry *cacheEntry, hits uint64) {
+	p := s.prefetch
+	if p == nil || !p.due(entry, hits) {
+		return
+	}
+
+	if _, alreadyInflight := p.inflight.LoadOrStore(key, struct{}{}); alreadyInflight {
+		return
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		// worker pool saturated, try again next time this entry is hit
+		p.inflight.Delete(key)
+		return
+	}
+
+	refreshReq := req.Copy()
+	go func() {
+		defer func() {
+			<-p.sem
+			p.inflight.Delete(key)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// Call refresh directly rather than exchangeWithCache: the entry
+		// being prefetched is by construction still unexpired, so
+		// exchangeWithCache's cache-hit check would just return it
+		// unchanged without ever reaching the upstream. refresh skips
+		// that check and goes straight to the singleflight-backed
+		// exchange, so it also dedupes with a real query racing for the
+		// same key.
+		q := refreshReq.Question[0]
+		s.refresh(ctx, refreshReq, key, isACMEChallenge(q.Name, q.Qtype))
+	}()
+}
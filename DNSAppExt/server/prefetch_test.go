@@ -0,0 +1,120 @@
+package dnsext
+
+import (
+	"context"
+	"github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingUpstream is a fake Upstream that answers every query with a
+// fresh A record and counts how many times Exchange was called.
+type countingUpstream struct {
+	calls uint64
+	stats upstreamStats
+}
+
+func (u *countingUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	atomic.AddUint64(&u.calls, 1)
+
+	r := msg.Copy()
+	r.Response = true
+	r.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(1, 2, 3, 4),
+	}}
+	return r, 0, nil
+}
+
+func (u *countingUpstream) String() string       { return "counting" }
+func (u *countingUpstream) Stats() *upstreamStats { return &u.stats }
+
+func TestPrefetcherDueRequiresMinHits(t *testing.T) {
+	p := &prefetcher{minHits: 3, threshold: 0.5}
+	entry := &cacheEntry{
+		ttl:    time.Minute,
+		expire: time.Now().Add(10 * time.Second), // about a sixth of the ttl left, under the 0.5 threshold
+	}
+
+	if p.due(entry, 2) {
+		t.Fatal("expected entry below minHits to not be due")
+	}
+	if !p.due(entry, 3) {
+		t.Fatal("expected entry at minHits and past the threshold to be due")
+	}
+}
+
+func TestPrefetcherDueRequiresNearExpiry(t *testing.T) {
+	p := &prefetcher{minHits: 1, threshold: 0.1}
+	entry := &cacheEntry{
+		ttl:    time.Minute,
+		expire: time.Now().Add(30 * time.Second), // half the ttl left, not within last 10%
+	}
+
+	if p.due(entry, 5) {
+		t.Fatal("expected entry with half its ttl left to not be due at a 10% threshold")
+	}
+
+	entry.expire = time.Now().Add(5 * time.Second) // within last 10%
+	if !p.due(entry, 5) {
+		t.Fatal("expected entry within the last 10% of its ttl to be due")
+	}
+}
+
+func TestPrefetchDisabledByDefault(t *testing.T) {
+	s := &Server{}
+	s.maybePrefetch(1, nil, &cacheEntry{ttl: time.Minute, expire: time.Now()}, 100)
+	// no panic, no prefetcher configured: nothing to assert beyond
+	// this not blocking or dereferencing a nil prefetcher.
+}
+
+// TestMaybePrefetchActuallyRefreshes guards against prefetch silently
+// re-reading the still-valid cached entry instead of reaching the
+// upstream: it qualifies an entry for prefetch and asserts the fake
+// upstream's Exchange is actually called.
+func TestMaybePrefetchActuallyRefreshes(t *testing.T) {
+	cache, err := lru.New(100)
+	if err != nil {
+		t.Fatalf("lru.New: %v", err)
+	}
+
+	up := &countingUpstream{}
+	s := &Server{
+		cache:     cache,
+		upstreams: []Upstream{up},
+		strategy:  Sequential,
+		prefetch: &prefetcher{
+			minHits:   1,
+			threshold: 1, // always due, regardless of remaining ttl
+			sem:       make(chan struct{}, prefetchWorkers),
+		},
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	entry := &cacheEntry{
+		msg:    req.Copy(),
+		ttl:    time.Minute,
+		expire: time.Now().Add(time.Minute),
+	}
+	entry.msg.Question[0].Name = "example.com."
+	entry.msg.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(5, 6, 7, 8),
+	}}
+
+	s.maybePrefetch(hash("example.com.", dns.TypeA), req, entry, 1)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadUint64(&up.calls) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if calls := atomic.LoadUint64(&up.calls); calls == 0 {
+		t.Fatal("expected prefetch to call the upstream's Exchange, got 0 calls")
+	}
+}
@@ -0,0 +1,87 @@
+package dnsext
+
+import (
+	"context"
+	"github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayedUpstream answers after delay with a TXT record echoing the
+// question name, so two concurrent refresh calls sharing a singleflight
+// key can be forced to race and their answers distinguished.
+type delayedUpstream struct {
+	delay time.Duration
+	stats upstreamStats
+}
+
+func (u *delayedUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	time.Sleep(u.delay)
+	r := msg.Copy()
+	r.Response = true
+	r.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{msg.Question[0].Name},
+	}}
+	return r, 0, nil
+}
+
+func (u *delayedUpstream) String() string       { return "delayed" }
+func (u *delayedUpstream) Stats() *upstreamStats { return &u.stats }
+
+// TestRefreshHandlesSingleflightKeyCollision guards against the
+// singleflight group, keyed by the same bare hash as the cache, cross
+// wiring two different in-flight qnames that happen to hash to the same
+// key: the waiter must get its own answer, not the leader's.
+func TestRefreshHandlesSingleflightKeyCollision(t *testing.T) {
+	cache, err := lru.New(100)
+	if err != nil {
+		t.Fatalf("lru.New: %v", err)
+	}
+
+	s := &Server{
+		cache:     cache,
+		upstreams: []Upstream{&delayedUpstream{delay: 50 * time.Millisecond}},
+		strategy:  Sequential,
+	}
+
+	reqA := &dns.Msg{}
+	reqA.SetQuestion("a.example.com.", dns.TypeTXT)
+	reqB := &dns.Msg{}
+	reqB.SetQuestion("b.example.com.", dns.TypeTXT)
+
+	const collidingKey = 42
+
+	results := make([]*dns.Msg, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r, err := s.refresh(context.Background(), reqA, collidingKey, false)
+		if err != nil {
+			t.Errorf("refresh A: %v", err)
+			return
+		}
+		results[0] = r
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond) // let A's exchange start first
+		r, err := s.refresh(context.Background(), reqB, collidingKey, false)
+		if err != nil {
+			t.Errorf("refresh B: %v", err)
+			return
+		}
+		results[1] = r
+	}()
+	wg.Wait()
+
+	if got := results[0].Question[0].Name; got != "a.example.com." {
+		t.Errorf("refresh A got an answer for %q", got)
+	}
+	if got := results[1].Question[0].Name; got != "b.example.com." {
+		t.Errorf("refresh B got an answer for %q, expected its own question despite the key collision", got)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -70,6 +71,8 @@ type addrList struct {
 	tlsClient *dns.Client
 	udpClient *dns.Client
 
+	bootstrap *Bootstrap
+
 	sync.RWMutex
 }
 
@@ -138,10 +141,25 @@ func newAddrList() *addrList {
 			Net:            "udp",
 			SingleInflight: true,
 		},
+		bootstrap: NewBootstrap(defaultBootstrapServers(), true),
 	}
 	return a
 }
 
+// setBootstrap swaps the bootstrap resolvers used to find a DoH
+// upstream's own address.
+func (a *addrList) setBootstrap(b *Bootstrap) {
+	a.Lock()
+	a.bootstrap = b
+	a.Unlock()
+}
+
+func (a *addrList) getBootstrap() *Bootstrap {
+	a.RLock()
+	defer a.RUnlock()
+	return a.bootstrap
+}
+
 func (a *addrList) lookupIPv(ctx context.Context, host, server string, ip4, tls bool) ([]dns.RR, error) {
 	msg := new(dns.Msg)
 	if ip4 {
@@ -173,105 +191,128 @@ func (a *addrList) lookupIPv(ctx context.Context, host, server string, ip4, tls
 	return res.Answer, nil
 }
 
-func (a *addrList) lookupIP(ctx context.Context, host string, tryOS, tryTLS bool) ([]net.IP, time.Time, error) {
-	if tryOS {
-		ips, err := net.LookupIP(host)
-
-		if err == nil && len(ips) > 0 {
-			for _, ip := range ips {
-				// only accept if addr isn't 0.0.0.0
-				if !ip.IsUnspecified() {
-					return ips, time.Now().Add(time.Minute), nil
-				}
-			}
-		}
+// lookupIP resolves host via the configured Bootstrap, returning
+// addresses in RFC 6724 preference order.
+func (a *addrList) lookupIP(ctx context.Context, host string) ([]net.IP, time.Time, error) {
+	ips, exp, err := a.getBootstrap().lookup(ctx, a, host)
+	if err != nil {
+		return nil, time.Time{}, err
 	}
+	return sortAddrs(ips, localAddrs()), exp, nil
+}
 
-	tryWithServer := func(ctx context.Context, server string, tls bool) (ip4, ip6 []net.IP, exp time.Time, err error) {
-		g, ctx := errgroup.WithContext(ctx)
+// queryServer resolves host's A+AAAA records against a single
+// bootstrap server, over whichever transport srv.Proto specifies.
+// There's no case for BootstrapDoQ: ParseBootstrapProto never produces
+// it, since there's no DoQ transport to run it over yet.
+func (a *addrList) queryServer(ctx context.Context, host string, srv BootstrapServer) (ip4, ip6 []net.IP, exp time.Time, err error) {
+	switch srv.Proto {
+	case BootstrapUDP:
+		return a.queryClassicDNS(ctx, host, srv.Addr, false)
+	case BootstrapDoT:
+		return a.queryClassicDNS(ctx, host, srv.Addr, true)
+	case BootstrapDoH:
+		return a.queryDoH(ctx, host, srv.Addr)
+	default:
+		return nil, nil, time.Time{}, fmt.Errorf("bootstrap proto %v isn't supported yet", srv.Proto)
+	}
+}
 
-		var ttl1, ttl2 uint32
-		g.Go(func() error {
-			rrs, err := a.lookupIPv(ctx, host, server, true, true)
-			if err != nil {
-				return err
-			}
-			for _, rr := range rrs {
-				if rr.Header().Rrtype == dns.TypeA {
-					ttl1 = rr.Header().Ttl
-					a4 := rr.(*dns.A)
-					ip4 = append(ip4, a4.A)
-				}
-			}
-			return nil
-		})
+func (a *addrList) queryClassicDNS(ctx context.Context, host, server string, tls bool) (ip4, ip6 []net.IP, exp time.Time, err error) {
+	g, ctx := errgroup.WithContext(ctx)
 
-		g.Go(func() error {
-			rrs, err := a.lookupIPv(ctx, host, server, false, true)
-			if err != nil {
-				return err
-			}
-			for _, rr := range rrs {
-				if rr.Header().Rrtype == dns.TypeAAAA {
-					ttl2 = rr.Header().Ttl
-					a6 := rr.(*dns.AAAA)
-					ip6 = append(ip6, a6.AAAA)
-				}
+	var ttl1, ttl2 uint32
+	g.Go(func() error {
+		rrs, err := a.lookupIPv(ctx, host, server, true, tls)
+		if err != nil {
+			return err
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeA {
+				ttl1 = rr.Header().Ttl
+				a4 := rr.(*dns.A)
+				ip4 = append(ip4, a4.A)
 			}
-			return nil
-		})
-
-		err = g.Wait()
-		if ttl2 < ttl1 {
-			ttl1 = ttl2
 		}
+		return nil
+	})
 
-		exp = time.Now().Add(time.Duration(ttl1) * time.Second)
-		return
-	}
-
-	// fallback
-	var lastErr error
-	for _, server := range bootstrapAddresses {
-		select {
-		case <-ctx.Done():
-			return nil, time.Time{}, fmt.Errorf("lookup failed context deadline exceeded")
-		default:
-			ip4, ip6, ttl, err := tryWithServer(ctx, server, tryTLS)
-			if err != nil {
-				lastErr = err
-				continue
+	g.Go(func() error {
+		rrs, err := a.lookupIPv(ctx, host, server, false, tls)
+		if err != nil {
+			return err
+		}
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeAAAA {
+				ttl2 = rr.Header().Ttl
+				a6 := rr.(*dns.AAAA)
+				ip6 = append(ip6, a6.AAAA)
 			}
-			log.Printf("found address using server: %s", server)
-			return mixAddrs(ip4, ip6), ttl, nil
 		}
+		return nil
+	})
+
+	err = g.Wait()
+	if ttl2 < ttl1 {
+		ttl1 = ttl2
 	}
 
-	return nil, time.Time{}, lastErr
+	exp = time.Now().Add(time.Duration(ttl1) * time.Second)
+	return
 }
 
-func mixAddrs(ip4, ip6 []net.IP) []net.IP {
-	var addrs []net.IP
-	// A/AAAA usually have the same length
-	// prefer ipv6
-	var addr1 = ip6
-	var addr2 = ip4
-
-	if len(ip4) < len(ip6) {
-		addr1 = ip4
-		addr2 = ip6
+// queryDoH resolves host's A+AAAA records against a DoH bootstrap
+// server, reusing the same dohUpstream transport the resolved
+// upstreams exchange over.
+func (a *addrList) queryDoH(ctx context.Context, host, rawURL string) (ip4, ip6 []net.IP, exp time.Time, err error) {
+	endpoint, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, time.Time{}, err
 	}
+	u := newDohUpstream(endpoint, &http.Client{Transport: dohTransport, Timeout: 5 * time.Second})
 
-	for idx, ip := range addr1 {
-		addrs = append(addrs, ip)
-		addrs = append(addrs, addr2[idx])
-	}
+	g, ctx := errgroup.WithContext(ctx)
+
+	var ttl1, ttl2 uint32
+	g.Go(func() error {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
+		res, _, err := u.Exchange(ctx, msg)
+		if err != nil {
+			return err
+		}
+		for _, rr := range res.Answer {
+			if a4, ok := rr.(*dns.A); ok {
+				ttl1 = rr.Header().Ttl
+				ip4 = append(ip4, a4.A)
+			}
+		}
+		return nil
+	})
+
+	g.Go(func() error {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
+		res, _, err := u.Exchange(ctx, msg)
+		if err != nil {
+			return err
+		}
+		for _, rr := range res.Answer {
+			if a6, ok := rr.(*dns.AAAA); ok {
+				ttl2 = rr.Header().Ttl
+				ip6 = append(ip6, a6.AAAA)
+			}
+		}
+		return nil
+	})
 
-	for i := len(addr1); i < len(addr2); i++ {
-		addrs = append(addrs, addr2[i])
+	err = g.Wait()
+	if ttl2 < ttl1 {
+		ttl1 = ttl2
 	}
 
-	return addrs
+	exp = time.Now().Add(time.Duration(ttl1) * time.Second)
+	return
 }
 
 func (a *addrList) getCachedAddrs(host string) []net.IP {
@@ -297,20 +338,12 @@ func (a *addrList) lookupDialAddrList(ctx context.Context, host string) ([]net.I
 		return addrs, nil
 	}
 
-	// try lookup with Dns over TLS max 1 second
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	ips, exp, err := a.lookupIP(ctx, host, false, true)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	ips, exp, err := a.lookupIP(ctx, host)
 	cancel()
 
 	if err != nil {
-		// try with OS or without TLS
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		ips, exp, err = a.lookupIP(ctx, host, true, false)
-		cancel()
-
-		if err != nil {
-			return nil, err
-		}
+		return nil, err
 	}
 
 	a.Lock()
@@ -0,0 +1,280 @@
+package dnsext
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy controls how Server.exchange distributes a query across the
+// configured upstreams.
+type Strategy int
+
+const (
+	// Sequential tries each upstream in configured order, failing over
+	// to the next one on error. This is the original single-upstream
+	// behavior when only one upstream is configured.
+	Sequential Strategy = iota
+	// Parallel fans the query out to every upstream at once and returns
+	// the first successful non-SERVFAIL response, cancelling the rest.
+	Parallel
+	// LoadBalance exchanges with upstreams ordered by recent RTT/error
+	// rate, biasing toward the fastest healthy endpoint, failing over
+	// to the next best on error.
+	LoadBalance
+)
+
+// ParseStrategy maps a strategy name to a Strategy, defaulting to
+// Sequential for anything unrecognized.
+func ParseStrategy(s string) Strategy {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "parallel":
+		return Parallel
+	case "loadbalance", "load_balance", "load-balance":
+		return LoadBalance
+	default:
+		return Sequential
+	}
+}
+
+// Upstream is a single configured resolver endpoint, either DoH or DoT.
+type Upstream interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error)
+	String() string
+	Stats() *upstreamStats
+}
+
+// upstreamStats tracks a rolling latency EWMA and failure/success counts
+// for an upstream so LoadBalance can rank endpoints and the UI can show
+// per-upstream failure counters.
+type upstreamStats struct {
+	failures  uint64
+	successes uint64
+
+	mu      sync.Mutex
+	rttEWMA time.Duration
+}
+
+const ewmaWeight = 0.2
+
+func (u *upstreamStats) record(rtt time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&u.failures, 1)
+		return
+	}
+	atomic.AddUint64(&u.successes, 1)
+
+	u.mu.Lock()
+	if u.rttEWMA == 0 {
+		u.rttEWMA = rtt
+	} else {
+		u.rttEWMA = time.Duration(float64(u.rttEWMA)*(1-ewmaWeight) + float64(rtt)*ewmaWeight)
+	}
+	u.mu.Unlock()
+}
+
+// score ranks upstreams for LoadBalance: lower is better. It penalizes
+// both latency and observed error rate.
+func (u *upstreamStats) score() float64 {
+	u.mu.Lock()
+	rtt := u.rttEWMA
+	u.mu.Unlock()
+	if rtt == 0 {
+		rtt = 50 * time.Millisecond
+	}
+
+	failures := atomic.LoadUint64(&u.failures)
+	total := failures + atomic.LoadUint64(&u.successes)
+	var errRate float64
+	if total > 0 {
+		errRate = float64(failures) / float64(total)
+	}
+
+	return float64(rtt) * (1 + 10*errRate)
+}
+
+// Failures returns the failure counter for UI display.
+func (u *upstreamStats) Failures() uint64 {
+	return atomic.LoadUint64(&u.failures)
+}
+
+// dohUpstream exchanges over the existing dohConn/http.Client transport.
+type dohUpstream struct {
+	endpoint *url.URL
+	http     *http.Client
+	dns      *dns.Client
+	stats    *upstreamStats
+}
+
+func newDohUpstream(endpoint *url.URL, httpClient *http.Client) *dohUpstream {
+	return &dohUpstream{
+		endpoint: endpoint,
+		http:     httpClient,
+		dns:      &dns.Client{},
+		stats:    &upstreamStats{},
+	}
+}
+
+func (d *dohUpstream) Exchange(ctx context.Context, msg *dns.Msg) (re *dns.Msg, rtt time.Duration, err error) {
+	re, rtt, err = d.dns.ExchangeWithConn(msg, &dns.Conn{Conn: &dohConn{
+		endpoint: d.endpoint,
+		http:     d.http,
+		ctx:      ctx,
+	}})
+	d.stats.record(rtt, err)
+	return
+}
+
+func (d *dohUpstream) String() string        { return d.endpoint.String() }
+func (d *dohUpstream) Stats() *upstreamStats { return d.stats }
+
+// dotUpstream exchanges over DNS-over-TLS using a plain tcp-tls
+// miekg/dns client, the same transport addrList uses to bootstrap.
+type dotUpstream struct {
+	addr   string
+	client *dns.Client
+	stats  *upstreamStats
+}
+
+func newDotUpstream(addr string) *dotUpstream {
+	return &dotUpstream{
+		addr: addr,
+		client: &dns.Client{
+			Net:     "tcp-tls",
+			Timeout: 6 * time.Second,
+		},
+		stats: &upstreamStats{},
+	}
+}
+
+func (d *dotUpstream) Exchange(ctx context.Context, msg *dns.Msg) (re *dns.Msg, rtt time.Duration, err error) {
+	re, rtt, err = d.client.ExchangeContext(ctx, msg, d.addr)
+	d.stats.record(rtt, err)
+	return
+}
+
+func (d *dotUpstream) String() string        { return "tls://" + d.addr }
+func (d *dotUpstream) Stats() *upstreamStats { return d.stats }
+
+// parseUpstreams turns the configured upstream strings into Upstream
+// implementations. Entries starting with "tls://" are DoT, everything
+// else is parsed as a DoH URL.
+func parseUpstreams(raw []string, httpClient *http.Client) ([]Upstream, error) {
+	var list []Upstream
+	for _, u := range raw {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+
+		if strings.HasPrefix(u, "tls://") {
+			addr := strings.TrimPrefix(u, "tls://")
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "853")
+			}
+			list = append(list, newDotUpstream(addr))
+			continue
+		}
+
+		endpoint, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("bad upstream %q: %v", u, err)
+		}
+		list = append(list, newDohUpstream(endpoint, httpClient))
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no upstreams configured")
+	}
+	return list, nil
+}
+
+// exchangeUpstreams dispatches msg to the configured upstreams according
+// to strategy.
+func exchangeUpstreams(ctx context.Context, upstreams []Upstream, strategy Strategy, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	switch strategy {
+	case Parallel:
+		return exchangeParallel(ctx, upstreams, msg)
+	case LoadBalance:
+		return exchangeRanked(ctx, upstreams, msg)
+	default:
+		return exchangeSequential(ctx, upstreams, msg)
+	}
+}
+
+func exchangeSequential(ctx context.Context, upstreams []Upstream, msg *dns.Msg) (re *dns.Msg, rtt time.Duration, err error) {
+	for _, u := range upstreams {
+		re, rtt, err = u.Exchange(ctx, msg)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// exchangeRanked is used by LoadBalance: it orders upstreams by their
+// current health score (lowest/best first) and tries them in that
+// order, failing over on error.
+func exchangeRanked(ctx context.Context, upstreams []Upstream, msg *dns.Msg) (re *dns.Msg, rtt time.Duration, err error) {
+	ranked := make([]Upstream, len(upstreams))
+	copy(ranked, upstreams)
+	sort.Slice(ranked, func(i, j int) bool {
+		return ranked[i].Stats().score() < ranked[j].Stats().score()
+	})
+
+	return exchangeSequential(ctx, ranked, msg)
+}
+
+type upstreamResult struct {
+	msg *dns.Msg
+	rtt time.Duration
+	err error
+}
+
+// exchangeParallel races all upstreams under a shared context and
+// returns the first successful non-SERVFAIL response, cancelling the
+// rest via ctx.
+func exchangeParallel(ctx context.Context, upstreams []Upstream, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan upstreamResult, len(upstreams))
+	for _, u := range upstreams {
+		u := u
+		go func() {
+			re, rtt, err := u.Exchange(ctx, msg.Copy())
+			results <- upstreamResult{re, rtt, err}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < len(upstreams); i++ {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				lastErr = res.err
+				continue
+			}
+			if res.msg.Rcode == dns.RcodeServerFailure {
+				lastErr = fmt.Errorf("servfail from upstream")
+				continue
+			}
+			return res.msg, res.rtt, nil
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("all upstreams failed")
+	}
+	return nil, 0, lastErr
+}